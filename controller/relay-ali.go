@@ -2,14 +2,19 @@ package controller
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"io"
 	"net/http"
 	"one-api/common"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // https://help.aliyun.com/document_detail/613695.html?spm=a2c4g.2399480.0.0.1adb778fAdzP9w#341800c0f8w0r
@@ -20,15 +25,60 @@ type AliMessage struct {
 }
 
 type AliInput struct {
-	Prompt  string       `json:"prompt"`
-	History []AliMessage `json:"history"`
+	Prompt   string         `json:"prompt,omitempty"`
+	History  []AliMessage   `json:"history,omitempty"`
+	Messages []AliVLMessage `json:"messages,omitempty"`
+}
+
+// aliVisionModels are the qwen-vl-* models that speak the messages-style
+// multimodal input/output shape instead of the prompt+history one.
+var aliVisionModels = map[string]bool{
+	"qwen-vl-plus": true,
+	"qwen-vl-max":  true,
+}
+
+func isAliVisionModel(model string) bool {
+	return aliVisionModels[model] || strings.HasPrefix(model, "qwen-vl-")
+}
+
+// AliVLContent is a single part of a qwen-vl message: either an image
+// reference or a text fragment.
+type AliVLContent struct {
+	Image string `json:"image,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+// AliVLMessage is the messages-mode request entry. Content is []AliVLContent
+// for qwen-vl-* (text/image parts) and a plain string for qwen's
+// tool-calling text models; Name/ToolCallId/ToolCalls only apply to the
+// latter, carrying a tool result or an assistant's function call back to
+// Ali in its own schema.
+type AliVLMessage struct {
+	Role       string        `json:"role"`
+	Content    interface{}   `json:"content,omitempty"`
+	Name       string        `json:"name,omitempty"`
+	ToolCallId string        `json:"tool_call_id,omitempty"`
+	ToolCalls  []AliToolCall `json:"tool_calls,omitempty"`
+}
+
+type AliToolCall struct {
+	Id       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Index    int    `json:"index,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function,omitempty"`
 }
 
 type AliParameters struct {
-	TopP         float64 `json:"top_p,omitempty"`
-	TopK         int     `json:"top_k,omitempty"`
-	Seed         uint64  `json:"seed,omitempty"`
-	EnableSearch bool    `json:"enable_search,omitempty"`
+	TopP         float64     `json:"top_p,omitempty"`
+	TopK         int         `json:"top_k,omitempty"`
+	Seed         uint64      `json:"seed,omitempty"`
+	EnableSearch bool        `json:"enable_search,omitempty"`
+	ResultFormat string      `json:"result_format,omitempty"`
+	Tools        []Tool      `json:"tools,omitempty"`
+	ToolChoice   interface{} `json:"tool_choice,omitempty"`
 }
 
 type AliChatRequest struct {
@@ -63,10 +113,25 @@ type AliTaskResponse struct {
 }
 
 type AliHeader struct {
-	Action    string `json:"action,omitempty"`
-	Streaming string `json:"streaming,omitempty"`
-	TaskID    string `json:"task_id,omitempty"`
-	Event     string `json:"event,omitempty"`
+	Action       string `json:"action,omitempty"`
+	Streaming    string `json:"streaming,omitempty"`
+	TaskID       string `json:"task_id,omitempty"`
+	Event        string `json:"event,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+type AliASRWord struct {
+	Text      string `json:"text"`
+	BeginTime int    `json:"begin_time"`
+	EndTime   int    `json:"end_time"`
+}
+
+type AliASRSentence struct {
+	Text      string       `json:"text"`
+	BeginTime int          `json:"begin_time,omitempty"`
+	EndTime   int          `json:"end_time,omitempty"` // non-zero once the sentence is final
+	Words     []AliASRWord `json:"words,omitempty"`
 }
 
 type AliPayload struct {
@@ -75,15 +140,20 @@ type AliPayload struct {
 	TaskGroup  string `json:"task_group,omitempty"`
 	Function   string `json:"function,omitempty"`
 	Parameters struct {
-		SampleRate int     `json:"sample_rate,omitempty"`
-		Rate       float64 `json:"rate,omitempty"`
-		Format     string  `json:"format,omitempty"`
+		SampleRate               int     `json:"sample_rate,omitempty"`
+		Rate                     float64 `json:"rate,omitempty"`
+		Format                   string  `json:"format,omitempty"`
+		DisfluencyRemovalEnabled bool    `json:"disfluency_removal_enabled,omitempty"`
 	} `json:"parameters,omitempty"`
 	Input struct {
 		Text string `json:"text,omitempty"`
 	} `json:"input,omitempty"`
+	Output struct {
+		Sentence AliASRSentence `json:"sentence,omitempty"`
+	} `json:"output,omitempty"`
 	Usage struct {
 		Characters int `json:"characters,omitempty"`
+		Seconds    int `json:"seconds,omitempty"`
 	} `json:"usage,omitempty"`
 }
 
@@ -124,12 +194,69 @@ type AliError struct {
 type AliUsage struct {
 	InputTokens  int `json:"input_tokens"`
 	OutputTokens int `json:"output_tokens"`
+	ImageTokens  int `json:"image_tokens,omitempty"`
 	TotalTokens  int `json:"total_tokens"`
 }
 
-type AliOutput struct {
-	Text         string `json:"text"`
+// AliOutputChoice is the messages-mode response shape used by qwen-vl-*
+// and by qwen's tool-calling models: output.choices[].message. Content is
+// a string for tool-calling text models and a []AliVLContent part list for
+// qwen-vl-*; ToolCalls is only populated when the model decided to call a
+// function instead of (or alongside) answering directly.
+type AliOutputChoice struct {
 	FinishReason string `json:"finish_reason"`
+	Message      struct {
+		Role      string        `json:"role"`
+		Content   interface{}   `json:"content"`
+		ToolCalls []AliToolCall `json:"tool_calls,omitempty"`
+	} `json:"message"`
+}
+
+type AliOutput struct {
+	Text         string            `json:"text"`
+	FinishReason string            `json:"finish_reason"`
+	Choices      []AliOutputChoice `json:"choices,omitempty"`
+}
+
+// aliOutputText extracts the assistant text regardless of whether the
+// model responded in the classic prompt/history shape (output.text) or the
+// messages shape used by qwen-vl-*/tool-calling models
+// (output.choices[].message.content), where content can itself be either a
+// plain string or a list of {"text": ...} parts.
+func aliOutputText(output AliOutput) string {
+	if len(output.Choices) == 0 {
+		return output.Text
+	}
+	switch content := output.Choices[0].Message.Content.(type) {
+	case string:
+		return content
+	case []interface{}:
+		var sb strings.Builder
+		for _, item := range content {
+			if part, ok := item.(map[string]interface{}); ok {
+				if text, ok := part["text"].(string); ok {
+					sb.WriteString(text)
+				}
+			}
+		}
+		return sb.String()
+	default:
+		return ""
+	}
+}
+
+func aliOutputToolCalls(output AliOutput) []AliToolCall {
+	if len(output.Choices) == 0 {
+		return nil
+	}
+	return output.Choices[0].Message.ToolCalls
+}
+
+func aliOutputFinishReason(output AliOutput) string {
+	if len(output.Choices) == 0 {
+		return output.FinishReason
+	}
+	return output.Choices[0].FinishReason
 }
 
 type AliChatResponse struct {
@@ -138,7 +265,84 @@ type AliChatResponse struct {
 	AliError
 }
 
-func requestOpenAI2Ali(request GeneralOpenAIRequest) *AliChatRequest {
+// buildAliVLMessages converts OpenAI multimodal messages (content as a list
+// of {type: "text"|"image_url", ...} parts) into qwen-vl's messages shape,
+// where each part is its own {"image": ...} or {"text": ...} object.
+func buildAliVLMessages(request GeneralOpenAIRequest) []AliVLMessage {
+	messages := make([]AliVLMessage, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		content := make([]AliVLContent, 0, 1)
+		for _, part := range message.ParseContent() {
+			switch part.Type {
+			case ContentTypeImageURL:
+				content = append(content, AliVLContent{Image: part.ImageURL.Url})
+			case ContentTypeText:
+				content = append(content, AliVLContent{Text: part.Text})
+			}
+		}
+		messages = append(messages, AliVLMessage{
+			Role:    message.Role,
+			Content: content,
+		})
+	}
+	return messages
+}
+
+// buildAliToolMessages converts OpenAI's messages-mode chat (system/user/
+// assistant/tool roles, assistant tool_calls, tool results) into Ali's
+// messages-mode schema. Used whenever the request carries tools, since the
+// classic prompt+history shape has nowhere to put a tool_call_id or a
+// function's arguments.
+func buildAliToolMessages(request GeneralOpenAIRequest) []AliVLMessage {
+	messages := make([]AliVLMessage, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		aliMessage := AliVLMessage{
+			Role:       message.Role,
+			Content:    message.StringContent(),
+			Name:       message.Name,
+			ToolCallId: message.ToolCallId,
+		}
+		for _, toolCall := range message.ToolCalls {
+			var call AliToolCall
+			call.Id = toolCall.Id
+			call.Type = toolCall.Type
+			call.Function.Name = toolCall.Function.Name
+			call.Function.Arguments = toolCall.Function.Arguments
+			aliMessage.ToolCalls = append(aliMessage.ToolCalls, call)
+		}
+		messages = append(messages, aliMessage)
+	}
+	return messages
+}
+
+func requestOpenAI2Ali(request GeneralOpenAIRequest) (*AliChatRequest, *OpenAIErrorWithStatusCode) {
+	if isAliVisionModel(request.Model) {
+		if len(request.Tools) > 0 || request.ToolChoice != nil {
+			err := fmt.Errorf("ali vision models do not support tool calling, got %d tools for model %s", len(request.Tools), request.Model)
+			return nil, errorWrapper(err, "ali_vision_tools_unsupported", http.StatusBadRequest)
+		}
+		return &AliChatRequest{
+			Model: request.Model,
+			Input: AliInput{
+				Messages: buildAliVLMessages(request),
+			},
+		}, nil
+	}
+
+	if len(request.Tools) > 0 || request.ToolChoice != nil {
+		return &AliChatRequest{
+			Model: request.Model,
+			Input: AliInput{
+				Messages: buildAliToolMessages(request),
+			},
+			Parameters: AliParameters{
+				ResultFormat: "message",
+				Tools:        request.Tools,
+				ToolChoice:   request.ToolChoice,
+			},
+		}, nil
+	}
+
 	messages := make([]AliMessage, 0, len(request.Messages))
 	prompt := ""
 	for i := 0; i < len(request.Messages); i++ {
@@ -173,7 +377,7 @@ func requestOpenAI2Ali(request GeneralOpenAIRequest) *AliChatRequest {
 		//	//Seed:         0,
 		//	//EnableSearch: false,
 		//},
-	}
+	}, nil
 }
 
 func requestOpenAI2AliTTS(request TextToSpeechRequest) *AliWSSMessage {
@@ -193,6 +397,53 @@ func requestOpenAI2AliTTS(request TextToSpeechRequest) *AliWSSMessage {
 	return &ttsRequest
 }
 
+// aliAudioFormats maps the filename extensions OpenAI's
+// /v1/audio/transcriptions endpoint accepts to the wire `format` values
+// Paraformer understands. Containers Ali's ASR task group has no entry for
+// (flac, mp4, mpeg, ogg/oga, webm) are deliberately left unmapped so the
+// upload is rejected by aliAudioFormat instead of being streamed to Ali
+// mislabeled as raw PCM.
+var aliAudioFormats = map[string]string{
+	"pcm":   "pcm",
+	"raw":   "pcm",
+	"wav":   "wav",
+	"mp3":   "mp3",
+	"mpga":  "mp3",
+	"m4a":   "aac",
+	"aac":   "aac",
+	"amr":   "amr",
+	"opus":  "opus",
+	"speex": "speex",
+	"spx":   "speex",
+}
+
+// aliAudioFormat derives the Ali `format` parameter from the uploaded file's
+// extension. ok is false when the extension isn't one of Ali's supported
+// formats, so the caller can reject the upload instead of guessing.
+func aliAudioFormat(filename string) (format string, ok bool) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	format, ok = aliAudioFormats[ext]
+	return format, ok
+}
+
+func requestOpenAI2AliASR(request AudioRequest, format string) *AliWSSMessage {
+	var asrRequest AliWSSMessage
+	asrRequest.Header.Action = "run-task"
+	asrRequest.Header.Streaming = "duplex"
+	asrRequest.Header.TaskID = uuid.New().String()
+	asrRequest.Payload.Function = "recognition"
+	asrRequest.Payload.Model = request.Model
+	asrRequest.Payload.Parameters.Format = format
+	if format == "pcm" {
+		asrRequest.Payload.Parameters.SampleRate = 16000
+	}
+	asrRequest.Payload.Parameters.DisfluencyRemovalEnabled = false
+	asrRequest.Payload.Task = "asr"
+	asrRequest.Payload.TaskGroup = "audio"
+
+	return &asrRequest
+}
+
 func embeddingRequestOpenAI2Ali(request GeneralOpenAIRequest) *AliEmbeddingRequest {
 	return &AliEmbeddingRequest{
 		Model: "text-embedding-v1",
@@ -257,14 +508,37 @@ func embeddingResponseAli2OpenAI(response *AliEmbeddingResponse) *OpenAIEmbeddin
 	return &openAIEmbeddingResponse
 }
 
+// aliToolCallsToOpenAI translates Ali's output.choices[].message.tool_calls
+// back into OpenAI's ChatCompletionMessageToolCall so tool-using clients see
+// identical wire behavior regardless of which provider actually answered.
+func aliToolCallsToOpenAI(calls []AliToolCall) []ChatCompletionMessageToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	toolCalls := make([]ChatCompletionMessageToolCall, 0, len(calls))
+	for _, call := range calls {
+		toolCalls = append(toolCalls, ChatCompletionMessageToolCall{
+			Id:    call.Id,
+			Type:  "function",
+			Index: call.Index,
+			Function: FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		})
+	}
+	return toolCalls
+}
+
 func responseAli2OpenAI(response *AliChatResponse) *OpenAITextResponse {
 	choice := OpenAITextResponseChoice{
 		Index: 0,
 		Message: Message{
-			Role:    "assistant",
-			Content: response.Output.Text,
+			Role:      "assistant",
+			Content:   aliOutputText(response.Output),
+			ToolCalls: aliToolCallsToOpenAI(aliOutputToolCalls(response.Output)),
 		},
-		FinishReason: response.Output.FinishReason,
+		FinishReason: aliOutputFinishReason(response.Output),
 	}
 	fullTextResponse := OpenAITextResponse{
 		Id:      response.RequestId,
@@ -272,9 +546,10 @@ func responseAli2OpenAI(response *AliChatResponse) *OpenAITextResponse {
 		Created: common.GetTimestamp(),
 		Choices: []OpenAITextResponseChoice{choice},
 		Usage: Usage{
-			PromptTokens:     response.Usage.InputTokens,
+			// image_tokens bill the input image the model had to process, same as OpenAI's vision models
+			PromptTokens:     response.Usage.InputTokens + response.Usage.ImageTokens,
 			CompletionTokens: response.Usage.OutputTokens,
-			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens + response.Usage.ImageTokens,
 		},
 	}
 	return &fullTextResponse
@@ -282,9 +557,9 @@ func responseAli2OpenAI(response *AliChatResponse) *OpenAITextResponse {
 
 func streamResponseAli2OpenAI(aliResponse *AliChatResponse) *ChatCompletionsStreamResponse {
 	var choice ChatCompletionsStreamResponseChoice
-	choice.Delta.Content = aliResponse.Output.Text
-	if aliResponse.Output.FinishReason != "null" {
-		finishReason := aliResponse.Output.FinishReason
+	choice.Delta.Content = aliOutputText(aliResponse.Output)
+	choice.Delta.ToolCalls = aliToolCallsToOpenAI(aliOutputToolCalls(aliResponse.Output))
+	if finishReason := aliOutputFinishReason(aliResponse.Output); finishReason != "null" && finishReason != "" {
 		choice.FinishReason = &finishReason
 	}
 	response := ChatCompletionsStreamResponse{
@@ -330,6 +605,7 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 	}()
 	setEventStreamHeaders(c)
 	lastResponseText := ""
+	lastToolCallArgs := make(map[int]string)
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
@@ -340,13 +616,28 @@ func aliStreamHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStat
 				return true
 			}
 			if aliResponse.Usage.OutputTokens != 0 {
-				usage.PromptTokens = aliResponse.Usage.InputTokens
+				// image_tokens bill the input image the model had to process, same as OpenAI's vision models
+				usage.PromptTokens = aliResponse.Usage.InputTokens + aliResponse.Usage.ImageTokens
 				usage.CompletionTokens = aliResponse.Usage.OutputTokens
-				usage.TotalTokens = aliResponse.Usage.InputTokens + aliResponse.Usage.OutputTokens
+				usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
 			}
 			response := streamResponseAli2OpenAI(&aliResponse)
+			responseText := aliOutputText(aliResponse.Output)
 			response.Choices[0].Delta.Content = strings.TrimPrefix(response.Choices[0].Delta.Content, lastResponseText)
-			lastResponseText = aliResponse.Output.Text
+			lastResponseText = responseText
+			// Ali resends each tool call's arguments in full on every frame
+			// rather than emitting incremental deltas; diff against what we
+			// last saw so downstream OpenAI SDK clients get the incremental
+			// delta.tool_calls[].function.arguments chunks they expect. Keyed
+			// by the call's own index, not its position in this frame's
+			// slice, since Ali's array order isn't guaranteed stable across
+			// frames once more than one tool call is in flight.
+			for i := range response.Choices[0].Delta.ToolCalls {
+				toolCall := &response.Choices[0].Delta.ToolCalls[i]
+				fullArguments := toolCall.Function.Arguments
+				toolCall.Function.Arguments = strings.TrimPrefix(fullArguments, lastToolCallArgs[toolCall.Index])
+				lastToolCallArgs[toolCall.Index] = fullArguments
+			}
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
 				common.SysError("error marshalling stream response: " + err.Error())
@@ -402,27 +693,285 @@ func aliHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode
 	return nil, &fullTextResponse.Usage
 }
 
+const (
+	aliImageTaskPollInterval = 1 * time.Second
+	aliImageTaskPollTimeout  = 60 * time.Second
+)
+
+type AliImageRequest struct {
+	Model string `json:"model"`
+	Input struct {
+		Prompt string `json:"prompt"`
+	} `json:"input"`
+	Parameters struct {
+		Size string `json:"size,omitempty"`
+		N    int    `json:"n,omitempty"`
+	} `json:"parameters,omitempty"`
+}
+
+func requestOpenAI2AliImage(request ImageRequest) *AliImageRequest {
+	imageRequest := &AliImageRequest{
+		Model: request.Model,
+	}
+	imageRequest.Input.Prompt = request.Prompt
+	imageRequest.Parameters.Size = strings.Replace(request.Size, "x", "*", 1)
+	imageRequest.Parameters.N = request.N
+	return imageRequest
+}
+
+// pollAliImageTask polls the DashScope task endpoint until the task reaches
+// a terminal state (SUCCEEDED/FAILED) or aliImageTaskPollTimeout elapses.
+func pollAliImageTask(taskId string, authorization string) (*AliTaskResponse, error) {
+	url := fmt.Sprintf("https://dashscope.aliyuncs.com/api/v1/tasks/%s", taskId)
+	client := &http.Client{Timeout: aliImageTaskPollInterval + 10*time.Second}
+	deadline := time.Now().Add(aliImageTaskPollTimeout)
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", authorization)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var taskResponse AliTaskResponse
+		err = json.NewDecoder(resp.Body).Decode(&taskResponse)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch taskResponse.Output.TaskStatus {
+		case "SUCCEEDED", "FAILED":
+			return &taskResponse, nil
+		}
+		if time.Now().After(deadline) {
+			return &taskResponse, fmt.Errorf("task %s timed out waiting for completion", taskId)
+		}
+		time.Sleep(aliImageTaskPollInterval)
+	}
+}
+
+func responseAliImage2OpenAI(response *AliTaskResponse) *ImageResponse {
+	imageResponse := ImageResponse{
+		Created: common.GetTimestamp(),
+	}
+	for _, result := range response.Output.Results {
+		imageResponse.Data = append(imageResponse.Data, ImageData{
+			Url:     result.Url,
+			B64Json: result.B64Image,
+		})
+	}
+	return &imageResponse
+}
+
+// aliImageHandler takes the response to an async image-synthesis submission,
+// polls the returned task id via pollAliImageTask until the task finishes,
+// and writes the resulting images as an OpenAI ImageResponse.
+func aliImageHandler(c *gin.Context, resp *http.Response) (*OpenAIErrorWithStatusCode, *Usage) {
+	var taskResponse AliTaskResponse
+	err := json.NewDecoder(resp.Body).Decode(&taskResponse)
+	if err != nil {
+		return errorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return errorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+
+	if taskResponse.Code != "" {
+		return &OpenAIErrorWithStatusCode{
+			OpenAIError: OpenAIError{
+				Message: taskResponse.Message,
+				Type:    taskResponse.Code,
+				Param:   taskResponse.RequestId,
+				Code:    taskResponse.Code,
+			},
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+
+	finalResponse, err := pollAliImageTask(taskResponse.Output.TaskId, c.Request.Header.Get("Authorization"))
+	if err != nil {
+		return errorWrapper(err, "poll_ali_task_failed", http.StatusInternalServerError), nil
+	}
+	if finalResponse.Output.TaskStatus == "FAILED" {
+		return &OpenAIErrorWithStatusCode{
+			OpenAIError: OpenAIError{
+				Message: finalResponse.Output.Message,
+				Type:    finalResponse.Output.Code,
+				Param:   finalResponse.RequestId,
+				Code:    finalResponse.Output.Code,
+			},
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	fullImageResponse := responseAliImage2OpenAI(finalResponse)
+	jsonResponse, err := json.Marshal(fullImageResponse)
+	if err != nil {
+		return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, err = c.Writer.Write(jsonResponse)
+	return nil, &Usage{}
+}
+
+const (
+	aliWSReadTimeout  = 30 * time.Second
+	aliWSWriteTimeout = 10 * time.Second
+	aliWSPingInterval = 15 * time.Second
+)
+
+// aliWSClient wraps a gorilla websocket.Conn to the DashScope inference
+// endpoint with the reliability behavior a raw conn doesn't give us for
+// free: read/write deadlines, and a ping/pong heartbeat so a half-open
+// socket is detected (and the read loop returns an error) instead of
+// hanging until the OS times it out.
+//
+// It deliberately does NOT redial on a dropped connection: Ali has no way
+// to resume a run-task mid-stream, so a reconnect would either make the
+// TTS handler replay the whole utterance from scratch while still
+// forwarding every new chunk to the client (duplicated audio), or leave an
+// ASR redial sitting on a brand-new task that never receives the audio
+// that was already sent (a stall). Failing fast is what lets the caller
+// surface a clean error to the client instead of corrupting or hanging the
+// response.
+type aliWSClient struct {
+	ctx  context.Context
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func newAliWSClient(ctx context.Context, url string, header http.Header) (*aliWSClient, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetPingHandler(func(appData string) error {
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(aliWSWriteTimeout))
+	})
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(aliWSReadTimeout))
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(aliWSReadTimeout))
+	client := &aliWSClient{ctx: ctx, conn: conn}
+	go client.heartbeat()
+	return client, nil
+}
+
+func (w *aliWSClient) heartbeat() {
+	ticker := time.NewTicker(aliWSPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			// Force an immediate read deadline so a readMessage blocked in
+			// conn.ReadMessage() unblocks as soon as the caller's context is
+			// canceled, instead of waiting out the full aliWSReadTimeout.
+			w.mu.Lock()
+			conn := w.conn
+			w.mu.Unlock()
+			if conn != nil {
+				_ = conn.SetReadDeadline(time.Now())
+			}
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			conn := w.conn
+			w.mu.Unlock()
+			if conn == nil {
+				return
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(aliWSWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (w *aliWSClient) writeJSON(v interface{}) error {
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(aliWSWriteTimeout))
+	return conn.WriteJSON(v)
+}
+
+func (w *aliWSClient) writeMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(aliWSWriteTimeout))
+	return conn.WriteMessage(messageType, data)
+}
+
+// readMessage reads the next frame. It does not retry: see the aliWSClient
+// doc comment for why a transparent redial would be worse than failing
+// fast here. A read blocked in conn.ReadMessage() is unblocked promptly on
+// context cancellation by heartbeat, which forces an immediate read
+// deadline once w.ctx.Done() fires.
+func (w *aliWSClient) readMessage() (int, []byte, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(aliWSReadTimeout))
+	return messageType, data, nil
+}
+
+func (w *aliWSClient) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// aliTaskFailedError converts a task-failed event into the same error
+// shape the HTTP handlers use, instead of letting it fall through the
+// switch and get swallowed as an unhandled event.
+func aliTaskFailedError(header AliHeader) *OpenAIErrorWithStatusCode {
+	return &OpenAIErrorWithStatusCode{
+		OpenAIError: OpenAIError{
+			Message: header.ErrorMessage,
+			Type:    "ali_task_failed",
+			Param:   header.TaskID,
+			Code:    header.ErrorCode,
+		},
+		StatusCode: http.StatusInternalServerError,
+	}
+}
+
 func aliTTSHandler(c *gin.Context, req TextToSpeechRequest) (*OpenAIErrorWithStatusCode, *Usage) {
 	Authorization := c.Request.Header.Get("Authorization")
 	baseURL := "wss://dashscope.aliyuncs.com/api-ws/v1/inference"
 	var usage Usage
 
-	conn, _, err := websocket.DefaultDialer.Dial(baseURL, http.Header{"Authorization": {Authorization}})
+	client, err := newAliWSClient(c.Request.Context(), baseURL, http.Header{"Authorization": {Authorization}})
 	if err != nil {
 		return errorWrapper(err, "wss_conn_failed", http.StatusInternalServerError), nil
 	}
-	defer conn.Close()
-
-	message := requestOpenAI2AliTTS(req)
+	defer client.Close()
 
-	if err := conn.WriteJSON(message); err != nil {
+	if err := client.writeJSON(requestOpenAI2AliTTS(req)); err != nil {
 		return errorWrapper(err, "wss_write_msg_failed", http.StatusInternalServerError), nil
 	}
 
 	const chunkSize = 1024
 
 	for {
-		messageType, audioData, err := conn.ReadMessage()
+		messageType, audioData, err := client.readMessage()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -433,10 +982,15 @@ func aliTTSHandler(c *gin.Context, req TextToSpeechRequest) (*OpenAIErrorWithSta
 		var msg AliWSSMessage
 		switch messageType {
 		case websocket.TextMessage:
-			err = json.Unmarshal(audioData, &msg)
-			if msg.Header.Event == "task-finished" {
+			if err := json.Unmarshal(audioData, &msg); err != nil {
+				continue
+			}
+			switch msg.Header.Event {
+			case "task-finished":
 				usage.TotalTokens = msg.Payload.Usage.Characters
 				return nil, &usage
+			case "task-failed":
+				return aliTaskFailedError(msg.Header), nil
 			}
 		case websocket.BinaryMessage:
 			for i := 0; i < len(audioData); i += chunkSize {
@@ -455,3 +1009,129 @@ func aliTTSHandler(c *gin.Context, req TextToSpeechRequest) (*OpenAIErrorWithSta
 
 	return nil, &usage
 }
+
+// aliSTTHandler transcribes via Ali's Paraformer ASR, returning a JSON body
+// with the transcript text only (no word timestamps).
+func aliSTTHandler(c *gin.Context, req AudioRequest) (*OpenAIErrorWithStatusCode, *Usage) {
+	return aliSTTRun(c, req, false)
+}
+
+// aliSTTVerboseJSONHandler is the verbose_json variant: it keeps each
+// finalized sentence's word-level timestamps instead of discarding them, so
+// callers asking for OpenAI's verbose_json transcription format get back a
+// `words` array derived from Ali's `words[]`.
+func aliSTTVerboseJSONHandler(c *gin.Context, req AudioRequest) (*OpenAIErrorWithStatusCode, *Usage) {
+	return aliSTTRun(c, req, true)
+}
+
+// aliSTTRun mirrors aliTTSHandler: it opens the same DashScope inference
+// websocket, but drives it the other way around, streaming the uploaded
+// audio in and accumulating the recognized text as it comes back.
+// collectWords additionally keeps each finalized sentence's word timestamps,
+// for the verbose_json response format.
+func aliSTTRun(c *gin.Context, req AudioRequest, collectWords bool) (*OpenAIErrorWithStatusCode, *Usage) {
+	Authorization := c.Request.Header.Get("Authorization")
+	baseURL := "wss://dashscope.aliyuncs.com/api-ws/v1/inference"
+	var usage Usage
+
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		return errorWrapper(err, "read_audio_file_failed", http.StatusBadRequest), nil
+	}
+	defer file.Close()
+
+	format, ok := aliAudioFormat(fileHeader.Filename)
+	if !ok {
+		err := fmt.Errorf("unsupported audio format for file %q, Ali's ASR task group accepts pcm/wav/mp3/opus/speex/aac/amr", fileHeader.Filename)
+		return errorWrapper(err, "unsupported_audio_format", http.StatusBadRequest), nil
+	}
+
+	client, err := newAliWSClient(c.Request.Context(), baseURL, http.Header{"Authorization": {Authorization}})
+	if err != nil {
+		return errorWrapper(err, "wss_conn_failed", http.StatusInternalServerError), nil
+	}
+	defer client.Close()
+
+	runTask := requestOpenAI2AliASR(req, format)
+	taskID := runTask.Header.TaskID
+	if err := client.writeJSON(runTask); err != nil {
+		return errorWrapper(err, "wss_write_msg_failed", http.StatusInternalServerError), nil
+	}
+
+	const chunkSize = 1024
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := file.Read(buf)
+		if n > 0 {
+			if writeErr := client.writeMessage(websocket.BinaryMessage, buf[:n]); writeErr != nil {
+				return errorWrapper(writeErr, "wss_write_audio_failed", http.StatusInternalServerError), nil
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return errorWrapper(readErr, "read_audio_file_failed", http.StatusInternalServerError), nil
+		}
+	}
+
+	var finishTask AliWSSMessage
+	finishTask.Header.Action = "finish-task"
+	finishTask.Header.Streaming = "duplex"
+	finishTask.Header.TaskID = taskID
+	if err := client.writeJSON(finishTask); err != nil {
+		return errorWrapper(err, "wss_write_msg_failed", http.StatusInternalServerError), nil
+	}
+
+	var transcript strings.Builder
+	var words []AudioResponseWord
+	for {
+		messageType, data, err := client.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errorWrapper(err, "wss_read_msg_failed", http.StatusInternalServerError), nil
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msg AliWSSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Header.Event {
+		case "result-generated":
+			sentence := msg.Payload.Output.Sentence
+			if sentence.EndTime != 0 {
+				transcript.WriteString(sentence.Text)
+				if collectWords {
+					for _, word := range sentence.Words {
+						words = append(words, AudioResponseWord{
+							Word:  word.Text,
+							Start: float64(word.BeginTime) / 1000,
+							End:   float64(word.EndTime) / 1000,
+						})
+					}
+				}
+			}
+		case "task-finished":
+			usage.TotalTokens = msg.Payload.Usage.Seconds
+			audioResponse := AudioResponse{Text: transcript.String()}
+			if collectWords {
+				audioResponse.Words = words
+			}
+			jsonResponse, err := json.Marshal(audioResponse)
+			if err != nil {
+				return errorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
+			}
+			c.Writer.Header().Set("Content-Type", "application/json")
+			_, err = c.Writer.Write(jsonResponse)
+			return nil, &usage
+		case "task-failed":
+			return aliTaskFailedError(msg.Header), nil
+		}
+	}
+
+	return nil, &usage
+}